@@ -19,18 +19,17 @@
 package server
 
 import (
+	"crypto/tls"
 	"fmt"
-	"io"
 	"net"
+	"net/http"
 	"os"
 	"strings"
-	"time"
 
 	"golang.org/x/net/context"
 
 	"github.com/TheNewNormal/corectl/components/host/session"
 	backendetcd "github.com/skynetservices/skydns/backends/etcd"
-	skymetrics "github.com/skynetservices/skydns/metrics"
 	skydns "github.com/skynetservices/skydns/server"
 )
 
@@ -45,14 +44,26 @@ var (
 type DNSServer struct {
 	sky           runner
 	dnsServerAddr *net.UDPAddr
+	metricsAddr   *net.TCPAddr
+	metricsPath   string
+	dotAddr       *net.TCPAddr
+	dohAddr       *net.TCPAddr
+	tlsConfig     *tls.Config
 	done          chan struct{}
+	started       bool
 }
 
 func (d *ServerContext) NewDNSServer(root,
-	serverAddress string, ns []string) (err error) {
+	serverAddress string, ns []string, metricsAddress, metricsPath string,
+	dotAddress, dohAddress string) (err error) {
 	var (
-		dnsAddress *net.UDPAddr
-		skyConfig  = &skydns.Config{
+		dnsAddress     *net.UDPAddr
+		metricsTCPAddr *net.TCPAddr
+		dotTCPAddr     *net.TCPAddr
+		dohTCPAddr     *net.TCPAddr
+		tlsConfig      *tls.Config
+		done           = make(chan struct{})
+		skyConfig      = &skydns.Config{
 			DnsAddr:     serverAddress,
 			Domain:      root,
 			Nameservers: ns,
@@ -62,22 +73,68 @@ func (d *ServerContext) NewDNSServer(root,
 	if dnsAddress, err = net.ResolveUDPAddr("udp", serverAddress); err != nil {
 		return
 	}
+	if metricsAddress != "" {
+		if metricsTCPAddr, err = net.ResolveTCPAddr(
+			"tcp", metricsAddress); err != nil {
+			return
+		}
+	}
+	if metricsPath == "" {
+		metricsPath = "/metrics"
+	}
+	if dotAddress != "" || dohAddress != "" {
+		certPath, keyPath, caErr := ensureCA()
+		if caErr != nil {
+			err = caErr
+			return
+		}
+		if tlsConfig, err = loadTLSConfig(certPath, keyPath); err != nil {
+			return
+		}
+	}
+	if dotAddress != "" {
+		if dotTCPAddr, err = net.ResolveTCPAddr("tcp", dotAddress); err != nil {
+			return
+		}
+	}
+	if dohAddress != "" {
+		if dohTCPAddr, err = net.ResolveTCPAddr("tcp", dohAddress); err != nil {
+			return
+		}
+	}
+
+	if skyConfig.Nameservers, err = startDoTForwarders(ns, done); err != nil {
+		return
+	}
 
 	skydns.SetDefaults(skyConfig)
 
+	stubs, stubTimeouts, err := loadStubs(StubsFile)
+	if err != nil {
+		return
+	}
+	if len(stubs) > 0 {
+		skyConfig.Stub = &stubs
+		skyConfig.ReadTimeout = stubReadTimeout(
+			stubTimeouts, skyConfig.ReadTimeout)
+	}
+
 	backend := backendetcd.NewBackend(d.EtcdClient, context.Background(),
 		&backendetcd.Config{
 			Ttl:      skyConfig.Ttl,
 			Priority: skyConfig.Priority,
 		})
-	skyServer := skydns.New(backend, skyConfig)
-
-	// setup so prometheus doesn't run into nil
-	skymetrics.Metrics()
+	skyServer := skydns.New(newInstrumentedBackend(backend), skyConfig)
 
 	d.DNSServer = &DNSServer{
 		sky:           skyServer,
 		dnsServerAddr: dnsAddress,
+		metricsAddr:   metricsTCPAddr,
+		metricsPath:   metricsPath,
+		dotAddr:       dotTCPAddr,
+		dohAddr:       dohTCPAddr,
+		tlsConfig:     tlsConfig,
+		done:          done,
 	}
 	// make host visible to the VMs by Name
 	if err = d.DNSServer.addRecord("corectld",
@@ -94,15 +151,40 @@ func (d *ServerContext) NewDNSServer(root,
 }
 
 func (dns *DNSServer) Start() {
-	if dns.done != nil {
+	if dns.started {
 		fmt.Fprint(os.Stderr, pad("DNS server already started"))
 		return
 	}
+	dns.started = true
+
+	go until(dns.sky.Run, "skydns", dns.done)
+
+	if dns.metricsAddr != nil {
+		mux := http.NewServeMux()
+		mux.Handle(dns.metricsPath, metricsHandler())
+		srv := &http.Server{Addr: dns.metricsAddr.String(), Handler: mux}
+		go until(srv.ListenAndServe, "dns-metrics", dns.done)
+	}
+
+	// /healthz is not gated on the opt-in metrics listener: it's the
+	// payoff of the supervisor's restart-rate limiter and needs to be
+	// reachable regardless of whether Prometheus scraping is enabled.
+	healthMux := http.NewServeMux()
+	healthMux.HandleFunc("/healthz", healthzHandler)
+	healthSrv := &http.Server{Addr: HealthAddr, Handler: healthMux}
+	go until(healthSrv.ListenAndServe, "dns-health", dns.done)
 
-	dns.done = make(chan struct{})
+	if dns.dotAddr != nil {
+		dns.startDoT(dns.dotAddr, dns.tlsConfig)
+	}
+	if dns.dohAddr != nil {
+		dns.startDoH(dns.dohAddr, dns.tlsConfig)
+	}
 
-	go until(dns.sky.Run, os.Stderr, "skydns", 1*time.Second, dns.done)
+	dns.reloadStaticRecords()
+	go dns.watchSIGHUP()
 
+	dns.startMDNS()
 }
 
 func (dns *DNSServer) Stop() {
@@ -145,6 +227,10 @@ func (d *DNSServer) addRecord(hostName string, ip string) (err error) {
 	_, err = Daemon.EtcdClient.Set(context.Background(),
 		"/skydns/arpa/in-addr/"+strings.Replace(ip, ".", "/", -1),
 		"{\"host\":\""+fqdn+"\", \"TTL\": 20 }", nil)
+	if err == nil {
+		vmRecordAdds.Inc()
+		registerMDNSHost(hostName, ip)
+	}
 	return
 }
 
@@ -159,36 +245,15 @@ func (d *DNSServer) rmRecord(hostName string, ip string) (err error) {
 	// reverse
 	_, err = Daemon.EtcdClient.Delete(context.Background(),
 		"/skydns/arpa/in-addr/"+strings.Replace(ip, ".", "/", -1), nil)
+	if err == nil {
+		vmRecordRemoves.Inc()
+		unregisterMDNSHost(hostName)
+	}
 	return
 }
 
-// helpers bellow loaned from kubernetes/minikube/blob/master/pkg/util/utils.go
-// we don't want to consume them straight as recent changes there bring a
-// XXL dep tail
-
-// Until endlessly loops the provided function until a message is received on
-// the done channel. The function will wait the duration provided in sleep
-// between function calls. Errors will be sent on provider Writer.
-func until(fn func() error, w io.Writer,
-	name string, sleep time.Duration, done <-chan struct{}) {
-	var exitErr error
-	for {
-		select {
-		case <-done:
-			return
-		default:
-			exitErr = fn()
-			if exitErr == nil {
-				fmt.Fprintf(w, pad("%s: Exited with no errors.\n"), name)
-			} else {
-				fmt.Fprintf(w, pad("%s: Exit with error: %v"), name, exitErr)
-			}
-
-			// wait provided duration before trying again
-			time.Sleep(sleep)
-		}
-	}
-}
+// until is now a proper exponential-backoff supervisor; see supervisor.go.
+
 func pad(str string) string {
-	return fmt.Sprint("\n%s\n", str)
+	return fmt.Sprintf("\n%s\n", str)
 }
@@ -0,0 +1,173 @@
+// Copyright (c) 2016 by António Meireles  <antonio.meireles@reformi.st>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package server
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	miekgdns "github.com/miekg/dns"
+)
+
+// startDoT launches a DNS-over-TLS (RFC 7858) listener on addr. Queries
+// are answered by re-issuing them against the plain UDP listener, so
+// skydns keeps a single authoritative resolution path.
+func (dns *DNSServer) startDoT(addr *net.TCPAddr, tlsConfig *tls.Config) {
+	srv := &miekgdns.Server{
+		Addr:      addr.String(),
+		Net:       "tcp-tls",
+		TLSConfig: tlsConfig,
+		Handler:   miekgdns.HandlerFunc(dns.forwardToUDP),
+	}
+	go until(srv.ListenAndServe, "dns-dot", dns.done)
+}
+
+// startDoH launches a DNS-over-HTTPS (RFC 8484) listener on addr,
+// answering both the GET (base64url "dns" query param) and POST
+// ("application/dns-message" body) forms.
+func (dns *DNSServer) startDoH(addr *net.TCPAddr, tlsConfig *tls.Config) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dns-query", dns.serveDoH)
+	srv := &http.Server{Addr: addr.String(), Handler: mux, TLSConfig: tlsConfig}
+	go until(func() error {
+		return srv.ListenAndServeTLS("", "")
+	}, "dns-doh", dns.done)
+}
+
+func (dns *DNSServer) forwardToUDP(w miekgdns.ResponseWriter, r *miekgdns.Msg) {
+	client := &miekgdns.Client{Net: "udp", Timeout: 5 * time.Second}
+	resp, _, err := client.Exchange(r, dns.dnsServerAddr.String())
+	if err != nil {
+		miekgdns.HandleFailed(w, r)
+		return
+	}
+	w.WriteMsg(resp)
+}
+
+func (dns *DNSServer) serveDoH(w http.ResponseWriter, req *http.Request) {
+	var (
+		raw []byte
+		err error
+	)
+
+	switch req.Method {
+	case http.MethodGet:
+		raw, err = base64.RawURLEncoding.DecodeString(req.URL.Query().Get("dns"))
+	case http.MethodPost:
+		raw, err = ioutil.ReadAll(req.Body)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	query := new(miekgdns.Msg)
+	if err = query.Unpack(raw); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	client := &miekgdns.Client{Net: "udp", Timeout: 5 * time.Second}
+	resp, _, err := client.Exchange(query, dns.dnsServerAddr.String())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	packed, err := resp.Pack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/dns-message")
+	w.Write(packed)
+}
+
+// startDoTForwarders rewrites any "tls://host:port" entry of ns into the
+// address of a local plaintext bridge, since skydns's own recursive
+// resolver only ever speaks plain DNS to its configured nameservers.
+// Each bridge relays queries to the real upstream over DoT so recursion
+// leaving the corectld host stays encrypted end to end.
+func startDoTForwarders(ns []string, done <-chan struct{}) (
+	rewritten []string, err error) {
+	for _, n := range ns {
+		if !strings.HasPrefix(n, "tls://") {
+			rewritten = append(rewritten, n)
+			continue
+		}
+		upstream := strings.TrimPrefix(n, "tls://")
+
+		var local *net.UDPConn
+		if local, err = net.ListenUDP("udp",
+			&net.UDPAddr{IP: net.ParseIP("127.0.0.1")}); err != nil {
+			return
+		}
+
+		go until(func() error {
+			return serveDoTForwarder(local, upstream, done)
+		}, "dns-dot-forwarder:"+upstream, done)
+		rewritten = append(rewritten, local.LocalAddr().String())
+	}
+	return
+}
+
+// serveDoTForwarder bridges plain UDP queries from local to upstream
+// over DoT until done is closed or the socket errors out, in which case
+// it returns the error so until can apply the same backoff/give-up
+// policy it applies to every other long-running goroutine here.
+func serveDoTForwarder(local *net.UDPConn, upstream string,
+	done <-chan struct{}) error {
+	client := &miekgdns.Client{Net: "tcp-tls", Timeout: 5 * time.Second}
+	buf := make([]byte, miekgdns.MaxMsgSize)
+
+	for {
+		select {
+		case <-done:
+			return nil
+		default:
+		}
+
+		local.SetReadDeadline(time.Now().Add(time.Second))
+		n, from, err := local.ReadFromUDP(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+
+		query := new(miekgdns.Msg)
+		if err = query.Unpack(buf[:n]); err != nil {
+			continue
+		}
+
+		resp, _, err := client.Exchange(query, upstream)
+		if err != nil {
+			continue
+		}
+		if packed, err := resp.Pack(); err == nil {
+			local.WriteToUDP(packed, from)
+		}
+	}
+}
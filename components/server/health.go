@@ -0,0 +1,75 @@
+// Copyright (c) 2016 by António Meireles  <antonio.meireles@reformi.st>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HealthAddr is where /healthz listens. Unlike the Prometheus endpoint
+// it is always on, since it's the only way to observe a supervised
+// component (DoT, DoH, mDNS, skydns itself, ...) that gave up restarting.
+var HealthAddr = "127.0.0.1:8611"
+
+// componentFailure is what the health endpoint reports for a component
+// the supervisor gave up restarting.
+type componentFailure struct {
+	LastError string    `json:"last_error"`
+	Attempts  int       `json:"attempts"`
+	GaveUpAt  time.Time `json:"gave_up_at"`
+}
+
+var health = struct {
+	sync.RWMutex
+	components map[string]componentFailure
+}{components: map[string]componentFailure{}}
+
+// recordSupervisorFailure is called by until once a component has
+// exceeded its restart-rate limit, so /healthz can surface it.
+func recordSupervisorFailure(name string, attempts int, err error) {
+	msg := ""
+	if err != nil {
+		msg = err.Error()
+	}
+	health.Lock()
+	health.components[name] = componentFailure{
+		LastError: msg, Attempts: attempts, GaveUpAt: time.Now(),
+	}
+	health.Unlock()
+}
+
+// healthzHandler reports 200 with an empty JSON object when every supervised
+// component is healthy, or 503 plus the failed components otherwise.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	health.RLock()
+	failed := make(map[string]componentFailure, len(health.components))
+	for name, f := range health.components {
+		failed[name] = f
+	}
+	health.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(failed) == 0 {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("{}"))
+		return
+	}
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(failed)
+}
@@ -0,0 +1,302 @@
+// Copyright (c) 2016 by António Meireles  <antonio.meireles@reformi.st>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	etcdclient "github.com/coreos/etcd/client"
+	miekgdns "github.com/miekg/dns"
+)
+
+// mdnsAddr is the standard mDNS multicast group/port (RFC 6762).
+var mdnsAddr = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+const sshServiceName = "_ssh._tcp.local."
+
+// mdnsHosts mirrors every VM A record currently handed to addRecord/
+// rmRecord, keyed by the short hostname (without LocalDomainName), so the
+// mDNS responder can answer "<hostname>.local." queries without round
+// tripping through etcd.
+var mdnsHosts = struct {
+	sync.RWMutex
+	m map[string]net.IP
+}{m: map[string]net.IP{}}
+
+func registerMDNSHost(hostName, ip string) {
+	if addr := net.ParseIP(ip); addr != nil {
+		mdnsHosts.Lock()
+		mdnsHosts.m[hostName] = addr
+		mdnsHosts.Unlock()
+	}
+}
+
+func unregisterMDNSHost(hostName string) {
+	mdnsHosts.Lock()
+	delete(mdnsHosts.m, hostName)
+	mdnsHosts.Unlock()
+}
+
+// startMDNS joins the mDNS multicast group and answers A (and ANY) queries
+// for every known VM under "<hostname>.local"; AAAA queries get no answer.
+// It also answers DNS-SD browsing for
+// "_ssh._tcp.local" and any user-defined SRV records, so `dns-sd -B` and
+// Finder's Bonjour browser see the VMs without editing resolv.conf.
+func (dns *DNSServer) startMDNS() {
+	seedMDNSHosts()
+
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsAddr)
+	if err != nil {
+		return
+	}
+	go until(func() error {
+		return serveMDNS(conn)
+	}, "mdns", dns.done)
+}
+
+func serveMDNS(conn *net.UDPConn) error {
+	buf := make([]byte, miekgdns.MaxMsgSize)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+
+		query := new(miekgdns.Msg)
+		if err = query.Unpack(buf[:n]); err != nil {
+			continue
+		}
+		answer := answerMDNS(query)
+		if answer == nil {
+			continue
+		}
+		packed, err := answer.Pack()
+		if err != nil {
+			continue
+		}
+
+		// RFC 6762 §5.4: multicast the reply unless every question asked
+		// for a unicast response (the QU bit), so passive browsers such
+		// as `dns-sd -B`/Finder watching the multicast group see it too.
+		dest := mdnsAddr
+		if queryWantsUnicast(query) {
+			dest = from
+		}
+		conn.WriteToUDP(packed, dest)
+	}
+}
+
+// queryWantsUnicast reports whether every question in query set the
+// mDNS "QU" bit, the top bit of the question's class field.
+func queryWantsUnicast(query *miekgdns.Msg) bool {
+	if len(query.Question) == 0 {
+		return false
+	}
+	for _, q := range query.Question {
+		if q.Qclass&(1<<15) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// seedMDNSHosts hydrates mdnsHosts from the A records already present in
+// etcd under LocalDomainName, so a corectld restart doesn't stop
+// advertising VMs that registered in a previous process's lifetime.
+func seedMDNSHosts() {
+	prefix := "/skydns/" + strings.Replace(invertDomain(LocalDomainName), ".", "/", -1)
+
+	resp, err := Daemon.EtcdClient.Get(context.Background(), prefix,
+		&etcdclient.GetOptions{Recursive: true})
+	if err != nil {
+		return
+	}
+	walkEtcdMDNSNodes(resp.Node, prefix)
+}
+
+func walkEtcdMDNSNodes(node *etcdclient.Node, prefix string) {
+	if node == nil {
+		return
+	}
+	if node.Dir {
+		for _, child := range node.Nodes {
+			walkEtcdMDNSNodes(child, prefix)
+		}
+		return
+	}
+
+	var svc struct {
+		Host string `json:"host"`
+	}
+	if err := json.Unmarshal([]byte(node.Value), &svc); err != nil {
+		return
+	}
+	// CNAME targets and other non-A records store a name, not an IP;
+	// only literal A records are useful to the mDNS responder.
+	if net.ParseIP(svc.Host) == nil {
+		return
+	}
+
+	if hostName := mdnsHostNameFromEtcdKey(node.Key, prefix); hostName != "" {
+		registerMDNSHost(hostName, svc.Host)
+	}
+}
+
+// mdnsHostNameFromEtcdKey undoes invertDomain: it turns an etcd key under
+// prefix back into the original dotted hostname addRecord was called
+// with.
+func mdnsHostNameFromEtcdKey(key, prefix string) string {
+	rel := strings.Trim(strings.TrimPrefix(key, prefix), "/")
+	if rel == "" {
+		return ""
+	}
+	labels := strings.Split(rel, "/")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return strings.Join(labels, ".")
+}
+
+// answerMDNS builds the mDNS reply for query, or nil when nothing in
+// this responder's records matches any of its questions.
+func answerMDNS(query *miekgdns.Msg) *miekgdns.Msg {
+	resp := new(miekgdns.Msg)
+	resp.SetReply(query)
+	resp.Authoritative = true
+
+	for _, q := range query.Question {
+		switch q.Qtype {
+		case miekgdns.TypeA, miekgdns.TypeANY:
+			resp.Answer = append(resp.Answer, aRecordsFor(q.Name)...)
+		case miekgdns.TypePTR:
+			if q.Name == sshServiceName {
+				resp.Answer = append(resp.Answer, sshPTRRecords()...)
+			}
+			resp.Answer = append(resp.Answer, staticPTRRecords(q.Name)...)
+		}
+	}
+
+	if len(resp.Answer) == 0 {
+		return nil
+	}
+	return resp
+}
+
+func aRecordsFor(name string) (rr []miekgdns.RR) {
+	hostName := strings.TrimSuffix(strings.TrimSuffix(name, "."), ".local")
+
+	mdnsHosts.RLock()
+	ip, ok := mdnsHosts.m[hostName]
+	mdnsHosts.RUnlock()
+	if !ok {
+		return
+	}
+
+	rr = append(rr, &miekgdns.A{
+		Hdr: miekgdns.RR_Header{
+			Name: name, Rrtype: miekgdns.TypeA, Class: miekgdns.ClassINET,
+			Ttl: 120,
+		},
+		A: ip.To4(),
+	})
+	return
+}
+
+// sshPTRRecords advertises every known VM as an _ssh._tcp service, so
+// Bonjour browsers can discover `ssh core@<host>.local` targets without
+// the host needing an explicit dns.d SRV entry.
+func sshPTRRecords() (rr []miekgdns.RR) {
+	mdnsHosts.RLock()
+	defer mdnsHosts.RUnlock()
+
+	for hostName := range mdnsHosts.m {
+		instance := hostName + "." + sshServiceName
+		rr = append(rr,
+			&miekgdns.PTR{
+				Hdr: miekgdns.RR_Header{
+					Name: sshServiceName, Rrtype: miekgdns.TypePTR,
+					Class: miekgdns.ClassINET, Ttl: 120,
+				},
+				Ptr: instance,
+			},
+			&miekgdns.SRV{
+				Hdr: miekgdns.RR_Header{
+					Name: instance, Rrtype: miekgdns.TypeSRV,
+					Class: miekgdns.ClassINET, Ttl: 120,
+				},
+				Target: hostName + ".local.", Port: 22,
+			},
+		)
+	}
+	return
+}
+
+// staticPTRRecords advertises any user-defined SRV record that declares a
+// "service" (e.g. "_http._tcp") as a DNS-SD service, using the same
+// owner/target split as sshPTRRecords: the PTR's owner is the
+// "_service._proto.local." meta-name a browser like `dns-sd -B` actually
+// queries, and its target is a distinct instance name carrying the SRV.
+func staticPTRRecords(service string) (rr []miekgdns.RR) {
+	records, err := loadStaticRecords(StaticRecordsDir)
+	if err != nil {
+		return
+	}
+	for _, r := range records {
+		if r.Type != "SRV" || r.Service == "" {
+			continue
+		}
+		meta := r.Service + ".local."
+		if meta != service {
+			continue
+		}
+
+		instance := r.Host + "." + meta
+		rr = append(rr,
+			&miekgdns.PTR{
+				Hdr: miekgdns.RR_Header{
+					Name: meta, Rrtype: miekgdns.TypePTR,
+					Class: miekgdns.ClassINET, Ttl: 120,
+				},
+				Ptr: instance,
+			},
+			&miekgdns.SRV{
+				Hdr: miekgdns.RR_Header{
+					Name: instance, Rrtype: miekgdns.TypeSRV,
+					Class: miekgdns.ClassINET, Ttl: 120,
+				},
+				Target:   r.Target + ".",
+				Port:     uint16(r.Port),
+				Priority: uint16(r.Priority),
+				Weight:   uint16(r.Weight),
+			},
+		)
+		if r.Text != "" {
+			rr = append(rr, &miekgdns.TXT{
+				Hdr: miekgdns.RR_Header{
+					Name: instance, Rrtype: miekgdns.TypeTXT,
+					Class: miekgdns.ClassINET, Ttl: 120,
+				},
+				Txt: []string{r.Text},
+			})
+		}
+	}
+	return
+}
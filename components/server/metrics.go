@@ -0,0 +1,119 @@
+// Copyright (c) 2016 by António Meireles  <antonio.meireles@reformi.st>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	skymetrics "github.com/skynetservices/skydns/metrics"
+	"github.com/skynetservices/skydns/msg"
+)
+
+var (
+	vmRecordAdds = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "corectld",
+		Subsystem: "dns",
+		Name:      "vm_record_adds_total",
+		Help:      "Number of VM DNS records added to etcd.",
+	})
+	vmRecordRemoves = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "corectld",
+		Subsystem: "dns",
+		Name:      "vm_record_removes_total",
+		Help:      "Number of VM DNS records removed from etcd.",
+	})
+	recordLookupFound = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "corectld",
+		Subsystem: "dns",
+		Name:      "record_lookup_found_total",
+		Help:      "Number of backend lookups that returned a record.",
+	})
+	recordLookupNotFound = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "corectld",
+		Subsystem: "dns",
+		Name:      "record_lookup_notfound_total",
+		Help:      "Number of backend lookups that found no matching record.",
+	})
+	domainQueries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "corectld",
+		Subsystem: "dns",
+		Name:      "domain_queries_total",
+		Help: "Number of queries seen per domain, bucketed by known zone " +
+			"to bound label cardinality.",
+	}, []string{"domain"})
+)
+
+func init() {
+	prometheus.MustRegister(vmRecordAdds, vmRecordRemoves,
+		recordLookupFound, recordLookupNotFound, domainQueries)
+}
+
+// metricsHandler wires up the SkyDNS metrics (registered via
+// skymetrics.Metrics so the collector doesn't panic on first scrape) next to
+// the corectld-specific counters above, and returns the combined
+// Prometheus scrape handler.
+func metricsHandler() http.Handler {
+	skymetrics.Metrics()
+	return promhttp.Handler()
+}
+
+// instrumentedBackend wraps a skydns backend, bumping the record-lookup
+// found/not-found and per-domain query counters on every Records lookup so
+// they show up on /metrics without having to patch skydns itself.
+// ReverseRecord lookups pass straight through and are not counted.
+type instrumentedBackend struct {
+	backend
+}
+
+// backend is the subset of skydns's etcd backend used by DNSServer; kept
+// local so this file doesn't need the concrete backendetcd type.
+type backend interface {
+	Records(name string, exact bool) ([]msg.Service, error)
+	ReverseRecord(name string) (*msg.Service, error)
+}
+
+func newInstrumentedBackend(b backend) *instrumentedBackend {
+	return &instrumentedBackend{backend: b}
+}
+
+func (i *instrumentedBackend) Records(name string, exact bool) ([]msg.Service, error) {
+	domainQueries.WithLabelValues(domainLabel(name)).Inc()
+
+	svc, err := i.backend.Records(name, exact)
+	if err != nil || len(svc) == 0 {
+		recordLookupNotFound.Inc()
+	} else {
+		recordLookupFound.Inc()
+	}
+	return svc, err
+}
+
+// domainLabel bounds the "domain" label's cardinality to the handful of
+// zones corectld actually serves, rather than the raw (and potentially
+// attacker-controlled, since corectld also answers recursive internet
+// queries) query name: anything outside LocalDomainName is bucketed as
+// "other".
+func domainLabel(name string) string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	zone := strings.ToLower(strings.TrimSuffix(LocalDomainName, "."))
+	if name == zone || strings.HasSuffix(name, "."+zone) {
+		return zone
+	}
+	return "other"
+}
@@ -0,0 +1,122 @@
+// Copyright (c) 2016 by António Meireles  <antonio.meireles@reformi.st>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// PKIDir holds the self-signed CA corectld generates the first time
+// DoT/DoH is enabled, so its fingerprint can be pinned inside VMs instead
+// of them trusting a public CA.
+var PKIDir = filepath.Join(os.Getenv("HOME"), ".coreos", "corectld", "pki")
+
+const (
+	caCertFile = "ca.pem"
+	caKeyFile  = "ca-key.pem"
+)
+
+// ensureCA returns the paths to the cert/key pair under PKIDir used for
+// DoT/DoH, generating a fresh self-signed CA on first run and printing
+// its SHA-256 fingerprint.
+func ensureCA() (certPath, keyPath string, err error) {
+	certPath = filepath.Join(PKIDir, caCertFile)
+	keyPath = filepath.Join(PKIDir, caKeyFile)
+
+	if _, statErr := os.Stat(certPath); statErr == nil {
+		return
+	}
+	if err = os.MkdirAll(PKIDir, 0700); err != nil {
+		return
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "corectld DNS CA"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage: x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature |
+			x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"corectld", "*." + LocalDomainName},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl,
+		&key.PublicKey, key)
+	if err != nil {
+		return
+	}
+
+	certOut, err := os.Create(certPath)
+	if err != nil {
+		return
+	}
+	defer certOut.Close()
+	if err = pem.Encode(certOut, &pem.Block{
+		Type: "CERTIFICATE", Bytes: der}); err != nil {
+		return
+	}
+
+	keyOut, err := os.OpenFile(keyPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return
+	}
+	defer keyOut.Close()
+	if err = pem.Encode(keyOut, &pem.Block{
+		Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)},
+	); err != nil {
+		return
+	}
+
+	sum := sha256.Sum256(der)
+	fmt.Fprintf(os.Stderr,
+		"corectld: generated DNS CA at %s\ncorectld: CA fingerprint (sha256): %x\n",
+		certPath, sum)
+	return
+}
+
+// loadTLSConfig builds the server-side TLS config shared by the DoT and
+// DoH listeners.
+func loadTLSConfig(certPath, keyPath string) (cfg *tls.Config, err error) {
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return
+	}
+	cfg = &tls.Config{Certificates: []tls.Certificate{cert}}
+	return
+}
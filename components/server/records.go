@@ -0,0 +1,242 @@
+// Copyright (c) 2016 by António Meireles  <antonio.meireles@reformi.st>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/net/context"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// StaticRecordsDir is where corectld looks for declarative DNS record
+// files, loaded at daemon start and reloaded on SIGHUP.
+var StaticRecordsDir = filepath.Join(os.Getenv("HOME"), ".corectl", "dns.d")
+
+// defaultStaticTtl is used for any record that doesn't set its own ttl.
+const defaultStaticTtl = 3600
+
+// StaticRecord is a single entry of a dns.d/*.yaml file. It maps onto a
+// skydns msg.Service, with only the fields relevant to its Type expected
+// to be set. Type is normalized to upper case by loadStaticRecords, so
+// every other consumer can compare against it directly.
+type StaticRecord struct {
+	Type     string `yaml:"type"`
+	Host     string `yaml:"host"`
+	Target   string `yaml:"target,omitempty"`
+	Priority int    `yaml:"priority,omitempty"`
+	Weight   int    `yaml:"weight,omitempty"`
+	Port     int    `yaml:"port,omitempty"`
+	Text     string `yaml:"text,omitempty"`
+	TTL      uint32 `yaml:"ttl,omitempty"`
+	// Service is the DNS-SD meta-service name (e.g. "_http._tcp") a SRV
+	// record is browsable under over mDNS. Ignored for other types.
+	Service string `yaml:"service,omitempty"`
+}
+
+// staticRecordsFile is the shape of a single dns.d/*.yaml file.
+type staticRecordsFile struct {
+	Records []StaticRecord `yaml:"records"`
+}
+
+// loadStaticRecords reads every *.yaml file under dir and returns the
+// combined list of declared records. A missing dir is not an error.
+func loadStaticRecords(dir string) (records []StaticRecord, err error) {
+	var matches []string
+	if matches, err = filepath.Glob(filepath.Join(dir, "*.yaml")); err != nil {
+		return
+	}
+	for _, path := range matches {
+		var (
+			raw []byte
+			f   staticRecordsFile
+		)
+		if raw, err = ioutil.ReadFile(path); err != nil {
+			return
+		}
+		if err = yaml.Unmarshal(raw, &f); err != nil {
+			err = fmt.Errorf("%s: %v", path, err)
+			return
+		}
+		for _, r := range f.Records {
+			r.Type = strings.ToUpper(r.Type)
+			records = append(records, r)
+		}
+	}
+	return
+}
+
+// applyStaticRecords writes every declared record to etcd under
+// /skydns/... using the same inverted-domain encoding as addRecord, so
+// skydns picks them up exactly as it would an auto-registered VM name.
+func (d *DNSServer) applyStaticRecords(records []StaticRecord) (err error) {
+	for _, r := range records {
+		if err = d.applyStaticRecord(r); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (d *DNSServer) applyStaticRecord(r StaticRecord) (err error) {
+	ttl := r.TTL
+	if ttl == 0 {
+		ttl = defaultStaticTtl
+	}
+
+	svc := struct {
+		Host     string `json:"host,omitempty"`
+		Priority int    `json:"priority,omitempty"`
+		Weight   int    `json:"weight,omitempty"`
+		Port     int    `json:"port,omitempty"`
+		Text     string `json:"text,omitempty"`
+		TTL      uint32 `json:"TTL"`
+	}{
+		Priority: r.Priority,
+		Weight:   r.Weight,
+		Port:     r.Port,
+		Text:     r.Text,
+		TTL:      ttl,
+	}
+
+	switch r.Type {
+	case "A", "AAAA":
+		svc.Host = r.Target
+	case "CNAME":
+		svc.Host = r.Target
+	case "SRV":
+		// skydns reads the record's target from "host" for every RR
+		// type, SRV included.
+		svc.Host = r.Target
+	case "TXT":
+		svc.Text = r.Text
+	default:
+		return fmt.Errorf("static DNS record %q: unsupported type %q",
+			r.Host, r.Type)
+	}
+
+	raw, err := json.Marshal(svc)
+	if err != nil {
+		return
+	}
+
+	_, err = Daemon.EtcdClient.Set(context.Background(), staticRecordPath(r.Host),
+		string(raw), nil)
+	if err != nil {
+		return
+	}
+
+	if r.Type == "A" || r.Type == "AAAA" {
+		registerMDNSHost(mdnsShortName(r.Host), r.Target)
+	}
+	return
+}
+
+// retractStaticRecord removes a record that used to be declared in
+// StaticRecordsDir but no longer is, undoing both the etcd write and any
+// mDNS registration applyStaticRecord made for it.
+func (d *DNSServer) retractStaticRecord(r StaticRecord) (err error) {
+	if _, err = Daemon.EtcdClient.Delete(context.Background(),
+		staticRecordPath(r.Host), nil); err != nil {
+		return
+	}
+	if r.Type == "A" || r.Type == "AAAA" {
+		unregisterMDNSHost(mdnsShortName(r.Host))
+	}
+	return
+}
+
+func staticRecordPath(host string) string {
+	return fmt.Sprintf("/skydns/%s",
+		strings.Replace(invertDomain(host), ".", "/", -1))
+}
+
+// mdnsShortName strips a trailing ".LocalDomainName" from host, so a
+// static record declared as e.g. "db.coreos.local" mirrors the same
+// "<name>.local" mDNS naming addRecord/rmRecord use for VMs.
+func mdnsShortName(host string) string {
+	return strings.TrimSuffix(host, "."+strings.TrimSuffix(LocalDomainName, "."))
+}
+
+// appliedStaticRecords is the record set reloadStaticRecords last loaded
+// and handed to applyStaticRecords (whether or not every write succeeded),
+// keyed by Host, so the next reload can tell what to retract.
+var appliedStaticRecords = struct {
+	sync.Mutex
+	byHost map[string]StaticRecord
+}{byHost: map[string]StaticRecord{}}
+
+// reloadStaticRecords re-reads StaticRecordsDir and re-applies every
+// record found, retracting any record that was removed or renamed since
+// the last load, without dropping the running skydns process.
+func (d *DNSServer) reloadStaticRecords() {
+	records, err := loadStaticRecords(StaticRecordsDir)
+	if err != nil {
+		fmt.Fprint(os.Stderr, pad(fmt.Sprintf(
+			"static DNS records: %v\n", err)))
+		return
+	}
+
+	current := make(map[string]StaticRecord, len(records))
+	for _, r := range records {
+		current[r.Host] = r
+	}
+
+	appliedStaticRecords.Lock()
+	stale := appliedStaticRecords.byHost
+	appliedStaticRecords.byHost = current
+	appliedStaticRecords.Unlock()
+
+	for host, r := range stale {
+		if _, ok := current[host]; ok {
+			continue
+		}
+		if err = d.retractStaticRecord(r); err != nil {
+			fmt.Fprint(os.Stderr, pad(fmt.Sprintf(
+				"static DNS records: %v\n", err)))
+		}
+	}
+
+	if err = d.applyStaticRecords(records); err != nil {
+		fmt.Fprint(os.Stderr, pad(fmt.Sprintf(
+			"static DNS records: %v\n", err)))
+	}
+}
+
+// watchSIGHUP reloads the declarative record set every time corectld
+// receives a SIGHUP, until dns.done is closed.
+func (d *DNSServer) watchSIGHUP() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	defer signal.Stop(ch)
+
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ch:
+			d.reloadStaticRecords()
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2016 by António Meireles  <antonio.meireles@reformi.st>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// StubsFile is where corectld looks for the conditional-forwarding
+// declaration: a "stubs" map of zone to upstream resolvers (e.g.
+// "corp.example.com: [10.0.0.53:53]") plus an optional "timeouts" map of
+// zone to per-stub read timeout (e.g. "corp.example.com: 2s").
+var StubsFile = filepath.Join(os.Getenv("HOME"), ".corectl", "dns.stubs.yaml")
+
+// stubsConfig is the shape of StubsFile.
+type stubsConfig struct {
+	Stubs    map[string][]string `yaml:"stubs"`
+	Timeouts map[string]string   `yaml:"timeouts,omitempty"`
+}
+
+// loadStubs reads path and returns the per-zone upstream resolvers plus
+// any per-stub timeout overrides. A missing file is not an error: it
+// just means no conditional forwarding is configured.
+func loadStubs(path string) (stubs map[string][]string,
+	timeouts map[string]time.Duration, err error) {
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	var cfg stubsConfig
+	if err = yaml.Unmarshal(raw, &cfg); err != nil {
+		err = fmt.Errorf("%s: %v", path, err)
+		return
+	}
+
+	stubs = cfg.Stubs
+	if len(cfg.Timeouts) > 0 {
+		timeouts = make(map[string]time.Duration, len(cfg.Timeouts))
+		for zone, raw := range cfg.Timeouts {
+			var d time.Duration
+			if d, err = time.ParseDuration(raw); err != nil {
+				err = fmt.Errorf("%s: stub %q: %v", path, zone, err)
+				return
+			}
+			timeouts[zone] = d
+		}
+	}
+	return
+}
+
+// stubReadTimeout collapses the per-stub timeouts down to a single
+// read timeout: the vendored skydns only exposes one global
+// Config.ReadTimeout, so when stubs disagree we take the minimum and
+// warn, rather than silently honoring only one of them.
+func stubReadTimeout(timeouts map[string]time.Duration,
+	fallback time.Duration) time.Duration {
+	if len(timeouts) == 0 {
+		return fallback
+	}
+
+	min := fallback
+	first := true
+	differ := false
+	for _, d := range timeouts {
+		if !first && d != min {
+			differ = true
+		}
+		if first || d < min {
+			min = d
+			first = false
+		}
+	}
+	if differ {
+		fmt.Fprint(os.Stderr, pad(fmt.Sprintf(
+			"stub timeouts differ per zone; skydns only supports one "+
+				"global read timeout, using the minimum (%s)\n", min)))
+	}
+	return min
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2016 by António Meireles  <antonio.meireles@reformi.st>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// supervisor.go replaces the old fixed 1s restart loop with an
+// exponential-backoff supervisor shared by the long-running servers in
+// this package (skydns, the metrics and health listeners, DoT, DoH, the
+// DoT forwarders, mDNS). The SIGHUP watcher is not supervised.
+
+package server
+
+import (
+	"log/slog"
+	"math/rand"
+	"os"
+	"time"
+)
+
+// SupervisorConfig tunes the restart policy applied by until.
+type SupervisorConfig struct {
+	MinBackoff    time.Duration
+	MaxBackoff    time.Duration
+	MaxFailures   int
+	FailureWindow time.Duration
+}
+
+// DefaultSupervisorConfig backs off from 250ms to 30s and gives up on a
+// component that fails 10 times inside a minute.
+var DefaultSupervisorConfig = SupervisorConfig{
+	MinBackoff:    250 * time.Millisecond,
+	MaxBackoff:    30 * time.Second,
+	MaxFailures:   10,
+	FailureWindow: time.Minute,
+}
+
+var supervisorLogger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+// SetSupervisorLogger lets the daemon plug in its own slog.Handler
+// instead of the default stderr text handler.
+func SetSupervisorLogger(h slog.Handler) {
+	supervisorLogger = slog.New(h)
+}
+
+// until restarts fn with exponential backoff and jitter until done is
+// closed, or until it has failed DefaultSupervisorConfig.MaxFailures
+// times within DefaultSupervisorConfig.FailureWindow, at which point it
+// records the failure on the health endpoint and gives up on name.
+func until(fn func() error, name string, done <-chan struct{}) {
+	cfg := DefaultSupervisorConfig
+	backoff := cfg.MinBackoff
+	var failures []time.Time
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		err := fn()
+
+		now := time.Now()
+		failures = append(failures, now)
+		cutoff := now.Add(-cfg.FailureWindow)
+		for len(failures) > 0 && failures[0].Before(cutoff) {
+			failures = failures[1:]
+		}
+		attempt := len(failures)
+
+		if err == nil {
+			supervisorLogger.Info("component exited with no error",
+				"component", name, "attempt", attempt)
+		} else {
+			supervisorLogger.Error("component exited with error",
+				"component", name, "attempt", attempt, "error", err)
+		}
+
+		if attempt >= cfg.MaxFailures {
+			recordSupervisorFailure(name, attempt, err)
+			supervisorLogger.Error("giving up after repeated failures",
+				"component", name, "attempts", attempt,
+				"window", cfg.FailureWindow)
+			return
+		}
+
+		// attempt == 1 means every earlier failure has aged out of
+		// FailureWindow, i.e. the component just finished a sustained
+		// healthy run: drop back to MinBackoff instead of carrying the
+		// old run's backoff forward.
+		if attempt == 1 {
+			backoff = cfg.MinBackoff
+		}
+
+		delay := backoff + time.Duration(
+			rand.Int63n(int64(backoff)/2+1))
+		supervisorLogger.Info("restarting component",
+			"component", name, "attempt", attempt, "next_retry", delay)
+
+		select {
+		case <-done:
+			return
+		case <-time.After(delay):
+		}
+
+		if backoff *= 2; backoff > cfg.MaxBackoff {
+			backoff = cfg.MaxBackoff
+		}
+	}
+}